@@ -2,6 +2,16 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+//go:build ignore
+// +build ignore
+
+// This file is kept only as a historical note: it was the entire
+// contents of rsc.io/compilebench back when the command itself lived at
+// golang.org/x/tools/cmd/compilebench, and a GOPATH build of this
+// package printed the message below instead of benchmarking anything.
+// The build constraint above keeps it out of the package so it no
+// longer conflicts with the real main in main.go.
+
 package main
 
 import "os"
@@ -9,7 +9,9 @@
 //	compilebench [options]
 //
 // It times the compilation of various packages and prints results in
-// the format used by package testing (and expected by rsc.io/benchstat).
+// the format used by package testing (and expected by rsc.io/benchstat),
+// including ns/op, user-ns/op, sys-ns/op, and maxrss-KB/op for every
+// benchmark, plus additional columns enabled by -alloc and -phases.
 //
 // The options are:
 //
@@ -34,16 +36,50 @@
 //	-memprofilerate rate
 //		Set runtime.MemProfileRate during compilation.
 //
+//	-linkflags 'list'
+//		Pass the space-separated list of flags to the linker.
+//
+//	-linkcpuprofile file
+//		Write a CPU profile of the linker to file.
+//
+//	-linkmemprofile file
+//		Write a memory profile of the linker to file.
+//
 //	-run regexp
 //		Only run benchmarks with names matching regexp.
 //
 //	-torture
-//		Include benchmarks that stress the compiler.
+//		Include benchmarks that stress the compiler, including the
+//		GC-stress benchmarks (BenchmarkParserStress, BenchmarkTreeStress,
+//		BenchmarkTree2Stress, BenchmarkPeanoStress), which compile large
+//		generated source files modeled on the test/bench/garbage suite.
 //		WARNING: Running these can make your computer unstable.
 //
-// Although -cpuprofile and -memprofile are intended to write a
-// combined profile for all the executed benchmarks to file,
-// today they write only the profile for the last benchmark executed.
+//	-gcpercent list
+//		Comma-separated list of GOGC percentages (or "off") to sweep
+//		for the GC-stress benchmarks (default "100"). Each value adds
+//		a row named, for example, BenchmarkParserStress/gogc=100.
+//
+//	-mod dir
+//		Treat dir as a Go module root and add a BenchmarkMod/<import-path>
+//		row timing the compilation of each of its packages.
+//
+//	-modtarget pkg
+//		With -mod, restrict the benchmarked packages to pkg and its
+//		transitive dependencies within the module, instead of ./....
+//
+//	-phases
+//		Also report per-phase compiler timings: parse-ns/op,
+//		typecheck-ns/op, ssa-ns/op, and codegen-ns/op. These come from
+//		an extra, untimed compile with its own -cpuprofile, so turning
+//		on -phases never affects the reported ns/op or user-ns/op.
+//
+// -cpuprofile and -memprofile write a profile merging the samples of
+// every executed benchmark (and, with -count greater than 1, every
+// iteration of each) to file. compilebench also writes, for each
+// benchmark, a profile containing only that benchmark's samples to
+// file.BenchmarkName (for example, -memprofile mem.prof produces
+// mem.prof.BenchmarkGoTypes alongside the merged mem.prof).
 //
 // The default memory profiling rate is one profile sample per 512 kB
 // allocated (see ``go doc runtime.MemProfileRate'').
@@ -64,7 +100,9 @@
 package main
 
 import (
+	"bytes"
 	"compress/gzip"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"go/build"
@@ -79,16 +117,29 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/google/pprof/profile"
 )
 
 var (
 	goroot   = runtime.GOROOT()
 	compiler string
+	linker   string
 	runRE    *regexp.Regexp
 	is6g     bool
 )
 
+// cpuProfiles and memProfiles accumulate the raw profile bytes gathered
+// from each run of a benchmark, keyed by benchmark name, so that they can
+// be merged across -count iterations and across all benchmarks once every
+// benchmark has finished running.
+var (
+	cpuProfiles = map[string][][]byte{}
+	memProfiles = map[string][][]byte{}
+)
+
 var (
 	flagAlloc          = flag.Bool("alloc", false, "report allocations")
 	flagToolexec       = flag.String("toolexec", "", "pass `exe` to cmd/go's -toolexec flag")
@@ -100,6 +151,13 @@ var (
 	flagMemprofilerate = flag.Int64("memprofilerate", -1, "set memory profile `rate`")
 	flagShort          = flag.Bool("short", false, "skip long-running benchmarks")
 	flagTorture        = flag.Bool("torture", false, "include compiler torture tests")
+	flagLinkFlags      = flag.String("linkflags", "", "additional `flags` to pass to the linker")
+	flagLinkCpuprofile = flag.String("linkcpuprofile", "", "write linker CPU profile to `file`")
+	flagLinkMemprofile = flag.String("linkmemprofile", "", "write linker memory profile to `file`")
+	flagGCPercent      = flag.String("gcpercent", "", "comma-separated `list` of GOGC percentages (or \"off\") to sweep for the GC-stress benchmarks")
+	flagMod            = flag.String("mod", "", "benchmark each package of the Go module rooted at `dir`")
+	flagModTarget      = flag.String("modtarget", "", "with -mod, restrict to `pkg` and its transitive dependencies")
+	flagPhases         = flag.Bool("phases", false, "report per-phase compiler timings (parse, typecheck, ssa, codegen)")
 )
 
 var tests = []struct {
@@ -116,6 +174,34 @@ var tests = []struct {
 	{"BenchmarkCmdGoSize", "", true},
 }
 
+// linkTests lists the benchmarks that time cmd/link rather than cmd/compile.
+// Each names a package (built ahead of time with ``go install -a'') or,
+// for BenchmarkLinkHelloWorld, a single source file.
+var linkTests = []struct {
+	name string
+	pkg  string
+}{
+	{"BenchmarkLinkCompiler", "cmd/compile"},
+	{"BenchmarkLinkCmdGo", "cmd/go"},
+	{"BenchmarkLinkHelloWorld", ""},
+}
+
+// gcTests lists the GC-stress benchmarks, each of which generates a large
+// synthetic source file modeled on one of the classic test/bench/garbage
+// workloads (parser.go, tree.go, tree2.go, peano.go) and times compiling
+// it under a sweep of GOGC values (see -gcpercent). They only run with
+// -torture, since a large GOGC sweep over large generated files can take
+// a while and use a lot of memory.
+var gcTests = []struct {
+	name string
+	gen  func(dir string) (file string, err error)
+}{
+	{"BenchmarkParserStress", genParserStress},
+	{"BenchmarkTreeStress", genTreeStress},
+	{"BenchmarkTree2Stress", genTree2Stress},
+	{"BenchmarkPeanoStress", genPeanoStress},
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, "usage: compilebench [options]\n")
 	fmt.Fprintf(os.Stderr, "options:\n")
@@ -123,15 +209,11 @@ func usage() {
 	os.Exit(2)
 }
 
-func main() {
-	log.SetFlags(0)
-	log.SetPrefix("compilebench: ")
-	flag.Usage = usage
-	flag.Parse()
-	if flag.NArg() != 0 {
-		usage()
-	}
-
+// findTool locates the compiler toolchain binary for the given tool name
+// (e.g. "compile" or "link"), falling back to the pre-Go-1.5 name oldName
+// (e.g. "6g" or "6l") for older toolchains. It sets is6g if the fallback
+// name was needed.
+func findTool(name, oldName string) string {
 	var exe string
 	var baseargs []string
 	if *flagToolexec != "" {
@@ -140,20 +222,33 @@ func main() {
 		exe = "go"
 		baseargs = []string{"tool"}
 	}
-	out, err := exec.Command(exe, append(baseargs, "-n", "compile")...).CombinedOutput()
+	out, err := exec.Command(exe, append(baseargs, "-n", name)...).CombinedOutput()
 	if err != nil {
-		out, err = exec.Command(exe, append(baseargs, "-n", "6g")...).CombinedOutput()
+		out, err = exec.Command(exe, append(baseargs, "-n", oldName)...).CombinedOutput()
 		is6g = true
 		if err != nil {
-			out, err = exec.Command(exe, append(baseargs, "tool", "-n", "compile")...).CombinedOutput()
+			out, err = exec.Command(exe, append(baseargs, "tool", "-n", name)...).CombinedOutput()
 			if *flagToolexec != "" {
-				log.Fatalf("%s -n compiler: %v\n%s", *flagToolexec, err, out)
+				log.Fatalf("%s -n %s: %v\n%s", *flagToolexec, name, err, out)
 			} else {
-				log.Fatalf("go tool -n compiler: %v\n%s", err, out)
+				log.Fatalf("go tool -n %s: %v\n%s", name, err, out)
 			}
 		}
 	}
-	compiler = strings.TrimSpace(string(out))
+	return strings.TrimSpace(string(out))
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("compilebench: ")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 0 {
+		usage()
+	}
+
+	compiler = findTool("compile", "6g")
+	linker = findTool("link", "6l")
 
 	if *flagRun != "" {
 		r, err := regexp.Compile(*flagRun)
@@ -163,6 +258,53 @@ func main() {
 		runRE = r
 	}
 
+	var link []struct {
+		name string
+		pkg  string
+	}
+	for _, lt := range linkTests {
+		if runRE == nil || runRE.MatchString(lt.name) {
+			link = append(link, lt)
+		}
+	}
+	for _, lt := range link {
+		target := lt.pkg
+		if target == "" {
+			target = filepath.Join(runtime.GOROOT(), "test/helloworld.go")
+		}
+		if err := prebuildLink(target); err != nil {
+			log.Printf("%v: %v", lt.name, err)
+		}
+	}
+
+	var modPkgs []modPkg
+	var modByPath map[string]modPkg
+	if *flagMod != "" {
+		modRoot, err := filepath.Abs(*flagMod)
+		if err != nil {
+			log.Fatalf("-mod %s: %v", *flagMod, err)
+		}
+		pattern := "./..."
+		if *flagModTarget != "" {
+			pattern = *flagModTarget
+		}
+		all, err := goListExport(modRoot, pattern)
+		if err != nil {
+			log.Fatalf("-mod %s: %v", *flagMod, err)
+		}
+		modByPath = make(map[string]modPkg)
+		for _, p := range all {
+			modByPath[p.ImportPath] = p
+		}
+		var mine []modPkg
+		for _, p := range all {
+			if p.Dir == modRoot || strings.HasPrefix(p.Dir, modRoot+string(filepath.Separator)) {
+				mine = append(mine, p)
+			}
+		}
+		modPkgs = topoSortPkgs(mine)
+	}
+
 	for i := 0; i < *flagCount; i++ {
 		for _, tt := range tests {
 			if tt.long && *flagShort {
@@ -172,6 +314,19 @@ func main() {
 				runBuild(tt.name, tt.dir, "")
 			}
 		}
+		for _, lt := range link {
+			target := lt.pkg
+			if target == "" {
+				target = filepath.Join(runtime.GOROOT(), "test/helloworld.go")
+			}
+			runLink(lt.name, target)
+		}
+		for _, p := range modPkgs {
+			name := "BenchmarkMod/" + p.ImportPath
+			if runRE == nil || runRE.MatchString(name) {
+				runModPkg(name, p, modByPath)
+			}
+		}
 	}
 
 	if *flagTorture {
@@ -182,7 +337,7 @@ func main() {
 			log.Fatalf("failed to find torture tests: %v", err)
 		}
 		if len(files) == 0 {
-			log.Fatalf("could not find torture tests; looked in %q", testdata)
+			log.Printf("no torture tests found in %q; skipping (the GC-stress benchmarks below still run)", testdata)
 		}
 		var r *gzip.Reader
 		for _, file := range files {
@@ -214,7 +369,97 @@ func main() {
 			}
 			os.Remove(tmp.Name())
 		}
+
+		for _, gt := range gcTests {
+			if runRE != nil && !runRE.MatchString(gt.name) {
+				continue
+			}
+			dir, err := ioutil.TempDir("", "compilebench-gcstress")
+			if err != nil {
+				log.Fatal(err)
+			}
+			file, err := gt.gen(dir)
+			if err != nil {
+				log.Printf("%v: %v", gt.name, err)
+				os.RemoveAll(dir)
+				continue
+			}
+			for _, percent := range gcPercents() {
+				runGCStress(gt.name, dir, file, percent)
+			}
+			os.RemoveAll(dir)
+		}
+	}
+
+	if err := writeProfiles(*flagCpuprofile, cpuProfiles); err != nil {
+		log.Printf("writing cpu profile: %v", err)
+	}
+	if err := writeProfiles(*flagMemprofile, memProfiles); err != nil {
+		log.Printf("writing memory profile: %v", err)
+	}
+}
+
+// writeProfiles merges the raw profiles recorded in profiles, keyed by
+// benchmark name, and writes them to disk: for each benchmark, a profile
+// containing only that benchmark's samples (merged across its -count
+// iterations) is written to path.name, and the merge of all of those is
+// written to path itself. It is a no-op if path is empty.
+func writeProfiles(path string, profiles map[string][][]byte) error {
+	if path == "" {
+		return nil
+	}
+	var all []*profile.Profile
+	for name, raws := range profiles {
+		var parsed []*profile.Profile
+		for _, raw := range raws {
+			p, err := profile.Parse(bytes.NewReader(raw))
+			if err != nil {
+				return fmt.Errorf("parsing profile for %s: %v", name, err)
+			}
+			parsed = append(parsed, p)
+		}
+		merged, err := profile.Merge(parsed)
+		if err != nil {
+			return fmt.Errorf("merging profile for %s: %v", name, err)
+		}
+		// Benchmark names can contain slashes (e.g. "BenchmarkMod/<import path>"),
+		// which os.Create would otherwise try to resolve as a subdirectory.
+		safeName := strings.Replace(name, "/", "_", -1)
+		if err := writeProfileFile(fmt.Sprintf("%s.%s", path, safeName), merged); err != nil {
+			return err
+		}
+		all = append(all, merged)
+	}
+	if len(all) == 0 {
+		return nil
+	}
+	final, err := profile.Merge(all)
+	if err != nil {
+		return fmt.Errorf("merging all profiles: %v", err)
+	}
+	return writeProfileFile(path, final)
+}
+
+func writeProfileFile(path string, p *profile.Profile) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := p.Write(f); err != nil {
+		f.Close()
+		return err
 	}
+	return f.Close()
+}
+
+// maxrssKB converts syscall.Rusage.Maxrss, whose unit is platform-specific
+// (kilobytes on Linux, bytes on Darwin), to kilobytes, matching the
+// maxrss-KB/op column's label.
+func maxrssKB(maxrss int64) int64 {
+	if runtime.GOOS == "darwin" {
+		return maxrss / 1024
+	}
+	return maxrss
 }
 
 func runCmd(name string, cmd *exec.Cmd) {
@@ -306,22 +551,26 @@ func runBuild(name, dir, file string) {
 	default:
 		log.Fatal("internal error: dir or file must be set")
 	}
-	args := []string{"-o", "_compilebench_.o"}
+	var baseArgs []string
 	if is6g {
 		*flagMemprofilerate = -1
 		*flagAlloc = false
 		*flagCpuprofile = ""
 		*flagMemprofile = ""
+		*flagPhases = false
 	}
 	if *flagMemprofilerate >= 0 {
-		args = append(args, "-memprofilerate", fmt.Sprint(*flagMemprofilerate))
+		baseArgs = append(baseArgs, "-memprofilerate", fmt.Sprint(*flagMemprofilerate))
 	}
-	args = append(args, strings.Fields(*flagCompilerFlags)...)
-	if *flagAlloc || *flagCpuprofile != "" || *flagMemprofile != "" {
+	baseArgs = append(baseArgs, strings.Fields(*flagCompilerFlags)...)
+
+	args := append([]string{"-o", "_compilebench_.o"}, baseArgs...)
+	needCPUProfile := *flagCpuprofile != ""
+	if *flagAlloc || needCPUProfile || *flagMemprofile != "" {
 		if *flagAlloc || *flagMemprofile != "" {
 			args = append(args, "-memprofile", "_compilebench_.memprof")
 		}
-		if *flagCpuprofile != "" {
+		if needCPUProfile {
 			args = append(args, "-cpuprofile", "_compilebench_.cpuprof")
 		}
 	}
@@ -336,6 +585,11 @@ func runBuild(name, dir, file string) {
 		return
 	}
 	end := time.Now()
+	var sysns, maxrss int64
+	if ru, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+		sysns = int64(ru.Stime.Sec)*1e9 + int64(ru.Stime.Usec)*1e3
+		maxrss = maxrssKB(ru.Maxrss)
+	}
 
 	var allocs, bytes int64
 	if *flagAlloc || *flagMemprofile != "" {
@@ -343,40 +597,424 @@ func runBuild(name, dir, file string) {
 		if err != nil {
 			log.Print("cannot find memory profile after compilation")
 		}
-		for _, line := range strings.Split(string(out), "\n") {
-			f := strings.Fields(line)
-			if len(f) < 4 || f[0] != "#" || f[2] != "=" {
+		bytes, allocs = parseMemprofileHeader(out)
+
+		if *flagMemprofile != "" {
+			memProfiles[name] = append(memProfiles[name], out)
+		}
+		os.Remove(pkgdir + "/_compilebench_.memprof")
+	}
+
+	if needCPUProfile {
+		out, err := ioutil.ReadFile(pkgdir + "/_compilebench_.cpuprof")
+		if err != nil {
+			log.Print(err)
+		}
+		cpuProfiles[name] = append(cpuProfiles[name], out)
+		os.Remove(pkgdir + "/_compilebench_.cpuprof")
+	}
+
+	// -phases takes its own, separate and untimed, compile below rather
+	// than reusing this one's -cpuprofile, so that turning -phases on
+	// does not perturb the ns/op and user-ns/op reported on this line.
+	var pt phaseTimes
+	if *flagPhases {
+		var err error
+		pt, err = collectPhaseTimes(pkgdir, baseArgs, files)
+		if err != nil {
+			log.Printf("%v: %v", name, err)
+		}
+	}
+
+	wallns := end.Sub(start).Nanoseconds()
+	userns := cmd.ProcessState.UserTime().Nanoseconds()
+
+	line := fmt.Sprintf("%s 1 %d ns/op %d user-ns/op %d sys-ns/op %d maxrss-KB/op", name, wallns, userns, sysns, maxrss)
+	if *flagAlloc {
+		line += fmt.Sprintf(" %d B/op %d allocs/op", bytes, allocs)
+	}
+	if *flagPhases {
+		line += fmt.Sprintf(" %d parse-ns/op %d typecheck-ns/op %d ssa-ns/op %d codegen-ns/op",
+			pt.parseNs, pt.typecheckNs, pt.ssaNs, pt.codegenNs)
+	}
+	fmt.Println(line)
+
+	os.Remove(pkgdir + "/_compilebench_.o")
+}
+
+// phaseTimes holds the per-phase compiler timings reported with -phases.
+type phaseTimes struct {
+	parseNs, typecheckNs, ssaNs, codegenNs int64
+}
+
+// collectPhaseTimes runs an extra compile of files in pkgdir, on top of
+// baseArgs, with its own -cpuprofile, purely to break that time down into
+// phaseTimes; the result is discarded and this run is not timed, so
+// turning -phases on never perturbs the ns/op and user-ns/op that runBuild
+// reports for its own, separately measured compile.
+func collectPhaseTimes(pkgdir string, baseArgs, files []string) (phaseTimes, error) {
+	var pt phaseTimes
+	args := append([]string{"-o", "_compilebench_phases.o"}, baseArgs...)
+	args = append(args, "-cpuprofile", "_compilebench_phases.cpuprof")
+	args = append(args, files...)
+	cmd := exec.Command(compiler, args...)
+	cmd.Dir = pkgdir
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	defer os.Remove(filepath.Join(pkgdir, "_compilebench_phases.o"))
+	defer os.Remove(filepath.Join(pkgdir, "_compilebench_phases.cpuprof"))
+	if err := cmd.Run(); err != nil {
+		return pt, fmt.Errorf("collecting phase times: %v", err)
+	}
+	out, err := ioutil.ReadFile(filepath.Join(pkgdir, "_compilebench_phases.cpuprof"))
+	if err != nil {
+		return pt, err
+	}
+	return readPhaseTimes(out)
+}
+
+// classifyPhase reports which phaseTimes bucket a compiler function name
+// (as found in a -cpuprofile profile) belongs to, and whether funcName
+// names a recognized parse/typecheck/ssa package. Everything else —
+// runtime helpers, and cmd/compile/internal's walk, escape, inline,
+// devirtualize, and object-writing packages — reports ok=false, so that
+// readPhaseTimes can fall through to those frames' callers instead of
+// defaulting the whole sample to codegen.
+func classifyPhase(funcName string) (bucket string, ok bool) {
+	switch {
+	case strings.HasPrefix(funcName, "cmd/compile/internal/syntax."):
+		return "parse", true
+	case strings.HasPrefix(funcName, "cmd/compile/internal/typecheck."),
+		strings.HasPrefix(funcName, "cmd/compile/internal/types2."),
+		strings.HasPrefix(funcName, "cmd/compile/internal/noder."):
+		return "typecheck", true
+	case strings.HasPrefix(funcName, "cmd/compile/internal/ssa."),
+		strings.HasPrefix(funcName, "cmd/compile/internal/ssagen."):
+		return "ssa", true
+	default:
+		return "codegen", false
+	}
+}
+
+// readPhaseTimes parses data as a CPU profile (taken with -cpuprofile
+// during compilation) and sums the time spent in each compiler phase's
+// packages into the four buckets compilebench reports: parse, typecheck,
+// ssa, and codegen.
+func readPhaseTimes(data []byte) (phaseTimes, error) {
+	var pt phaseTimes
+	prof, err := profile.Parse(bytes.NewReader(data))
+	if err != nil {
+		return pt, fmt.Errorf("parsing cpu profile: %v", err)
+	}
+	valueIndex, scale := -1, int64(1)
+	for i, st := range prof.SampleType {
+		if st.Type == "cpu" && st.Unit == "nanoseconds" {
+			valueIndex, scale = i, 1
+			break
+		}
+		if st.Type == "samples" {
+			valueIndex, scale = i, prof.Period
+		}
+	}
+	for _, s := range prof.Sample {
+		if valueIndex < 0 || valueIndex >= len(s.Value) {
+			continue
+		}
+		ns := s.Value[valueIndex] * scale
+		pt.add(samplePhase(s), ns)
+	}
+	return pt, nil
+}
+
+// samplePhase classifies a profile sample by the outermost (closest to the
+// call stack's root) parse/typecheck/ssa frame found anywhere in it, rather
+// than by its leaf frame: a sample whose leaf is a runtime helper or a
+// generic utility called from deep inside the SSA backend, for example,
+// should still be attributed to ssa, not fall through to the codegen
+// catch-all just because the innermost frame doesn't itself match. Both
+// s.Location and, within a location, Location.Line are ordered
+// innermost-first, so the outermost match is found by scanning both in
+// reverse.
+func samplePhase(s *profile.Sample) string {
+	for i := len(s.Location) - 1; i >= 0; i-- {
+		loc := s.Location[i]
+		for j := len(loc.Line) - 1; j >= 0; j-- {
+			fn := loc.Line[j].Function
+			if fn == nil {
 				continue
 			}
-			val, err := strconv.ParseInt(f[3], 0, 64)
-			if err != nil {
-				continue
+			if bucket, ok := classifyPhase(fn.Name); ok {
+				return bucket
+			}
+		}
+	}
+	return "codegen"
+}
+
+// add accumulates ns into the phaseTimes field named by bucket.
+func (pt *phaseTimes) add(bucket string, ns int64) {
+	switch bucket {
+	case "parse":
+		pt.parseNs += ns
+	case "typecheck":
+		pt.typecheckNs += ns
+	case "ssa":
+		pt.ssaNs += ns
+	default:
+		pt.codegenNs += ns
+	}
+}
+
+// parseProfileHeader parses the ``# Name = value'' style header that
+// runtime writes at the top of a legacy memory profile (the format
+// produced by cmd/compile's and cmd/link's -memprofile flags), returning
+// the values keyed by name (for example "TotalAlloc", "Mallocs", "NumGC").
+func parseProfileHeader(out []byte) map[string]int64 {
+	vals := make(map[string]int64)
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 4 || f[0] != "#" || f[2] != "=" {
+			continue
+		}
+		val, err := strconv.ParseInt(f[3], 0, 64)
+		if err != nil {
+			continue
+		}
+		vals[f[1]] = val
+	}
+	return vals
+}
+
+// parseMemprofileHeader extracts the TotalAlloc and Mallocs counters from a
+// legacy memory profile header.
+func parseMemprofileHeader(out []byte) (bytes, allocs int64) {
+	vals := parseProfileHeader(out)
+	return vals["TotalAlloc"], vals["Mallocs"]
+}
+
+// parseGCStats extracts the runtime.MemStats counters that describe GC
+// behavior during compilation from a legacy memory profile header.
+func parseGCStats(out []byte) (gcns, cycles, heap int64) {
+	vals := parseProfileHeader(out)
+	return parsePauseNs(out), vals["NumGC"], vals["HeapAlloc"]
+}
+
+// parsePauseNs sums the ``# PauseNs = [...]'' array that a legacy memory
+// profile header prints: runtime.MemStats.PauseNs, the circular buffer of
+// individual STW pause durations, formatted with %v rather than the
+// ``# Name = value'' style parseProfileHeader understands. There is no
+// ``PauseTotalNs'' line in this header to fall back on, so this is the
+// only way to recover total GC pause time from it.
+func parsePauseNs(out []byte) int64 {
+	text := string(out)
+	i := strings.Index(text, "PauseNs = [")
+	if i < 0 {
+		return 0
+	}
+	text = text[i+len("PauseNs = ["):]
+	if j := strings.IndexByte(text, ']'); j >= 0 {
+		text = text[:j]
+	}
+	var total int64
+	for _, f := range strings.Fields(text) {
+		n, err := strconv.ParseInt(f, 0, 64)
+		if err != nil {
+			continue
+		}
+		total += n
+	}
+	return total
+}
+
+// prebuildLink does the one-time work of building pkg (a package import
+// path, or a path to a single .go file) and all its dependencies with
+// ``go install -a'' (or, for a single file, ``go build -a''), so that the
+// later timed run of runLink only needs to invoke the linker itself.
+func prebuildLink(pkg string) error {
+	args := []string{"install", "-a"}
+	if strings.HasSuffix(pkg, ".go") {
+		tmp, err := ioutil.TempFile("", "compilebench-link")
+		if err != nil {
+			return err
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+		args = []string{"build", "-a", "-o", tmp.Name()}
+	}
+	if *flagToolexec != "" {
+		args = append(args, "-toolexec", *flagToolexec)
+	}
+	args = append(args, pkg)
+	cmd := exec.Command("go", args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// linkCommand runs ``go build -x -work'' to actually build pkg into out,
+// and returns the command line, from that build's -x trace, that invokes
+// the linker, along with the $WORK directory the build retained (which
+// the caller must remove once done). Because prebuildLink has already
+// installed pkg and its dependencies, this build only has to redo the
+// link step, so the extra build stays cheap. cmd/go's -x trace writes
+// paths under $WORK using the literal string "$WORK" rather than the
+// real, per-run temporary directory; -work keeps that directory around
+// (it is normally removed when the build finishes) so the returned
+// command, with $WORK substituted back in, can be rerun directly and
+// timed as the benchmark.
+func linkCommand(pkg, out string) ([]string, string, error) {
+	args := []string{"build", "-x", "-work", "-o", out}
+	if *flagToolexec != "" {
+		args = append(args, "-toolexec", *flagToolexec)
+	}
+	args = append(args, pkg)
+	cmdOut, err := exec.Command("go", args...).CombinedOutput()
+	if err != nil {
+		return nil, "", fmt.Errorf("go build -x -work: %v\n%s", err, cmdOut)
+	}
+	var workDir string
+	var linkArgs []string
+	for _, line := range strings.Split(string(cmdOut), "\n") {
+		if w := strings.TrimPrefix(line, "WORK="); w != line {
+			workDir = w
+			continue
+		}
+		if linkArgs != nil {
+			continue
+		}
+		fields := shellFields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == linker || filepath.Base(fields[0]) == filepath.Base(linker) {
+			linkArgs = fields
+		}
+	}
+	if workDir == "" {
+		return nil, "", fmt.Errorf("could not find $WORK directory in go build -x -work output")
+	}
+	if linkArgs == nil {
+		os.RemoveAll(workDir)
+		return nil, "", fmt.Errorf("could not find link command in go build -x -work output")
+	}
+	for i, f := range linkArgs {
+		linkArgs[i] = strings.Replace(f, "$WORK", workDir, -1)
+	}
+	return linkArgs, workDir, nil
+}
+
+// shellFields splits a line of shell-quoted words, as printed by
+// ``go build -x'', into fields. It understands the single-quoting that
+// cmd/go uses to protect arguments (such as $WORK paths) containing
+// spaces or other special characters.
+func shellFields(line string) []string {
+	var fields []string
+	var cur strings.Builder
+	inQuote := false
+	have := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\'' && !inQuote:
+			inQuote = true
+			have = true
+		case c == '\'' && inQuote:
+			if i+1 < len(line) && line[i+1] == '\'' {
+				cur.WriteByte('\'')
+				i++
+			} else {
+				inQuote = false
 			}
-			switch f[1] {
-			case "TotalAlloc":
-				bytes = val
-			case "Mallocs":
-				allocs = val
+		case c == ' ' && !inQuote:
+			if have {
+				fields = append(fields, cur.String())
+				cur.Reset()
+				have = false
 			}
+		default:
+			cur.WriteByte(c)
+			have = true
 		}
+	}
+	if have {
+		fields = append(fields, cur.String())
+	}
+	return fields
+}
 
-		if *flagMemprofile != "" {
-			if err := ioutil.WriteFile(*flagMemprofile, out, 0666); err != nil {
+// runLink runs and times the link step of building pkg (a package import
+// path, or a path to a single .go file), reporting results under name in
+// the same style as runBuild.
+func runLink(name, pkg string) {
+	tmp, err := ioutil.TempFile("", "compilebench-link")
+	if err != nil {
+		log.Printf("%v: %v", name, err)
+		return
+	}
+	out := tmp.Name()
+	tmp.Close()
+	os.Remove(out)
+	defer os.Remove(out)
+
+	args, workDir, err := linkCommand(pkg, out)
+	if err != nil {
+		log.Printf("%v: %v", name, err)
+		return
+	}
+	defer os.RemoveAll(workDir)
+
+	// The linker, like the compiler, stops parsing flags at its first
+	// positional argument (the .a file to link), so any extra flags have
+	// to be inserted before that trailing argument, not appended after it.
+	var extra []string
+	extra = append(extra, strings.Fields(*flagLinkFlags)...)
+	if *flagAlloc || *flagLinkMemprofile != "" {
+		extra = append(extra, "-memprofile", out+".memprof")
+	}
+	if *flagLinkCpuprofile != "" {
+		extra = append(extra, "-cpuprofile", out+".cpuprof")
+	}
+	if len(extra) > 0 {
+		last := args[len(args)-1]
+		args = append(args[:len(args)-1:len(args)-1], extra...)
+		args = append(args, last)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		log.Printf("%v: %v", name, err)
+		return
+	}
+	end := time.Now()
+
+	var allocs, bytes int64
+	if *flagAlloc || *flagLinkMemprofile != "" {
+		data, err := ioutil.ReadFile(out + ".memprof")
+		if err != nil {
+			log.Print("cannot find memory profile after link")
+		}
+		bytes, allocs = parseMemprofileHeader(data)
+
+		if *flagLinkMemprofile != "" {
+			if err := ioutil.WriteFile(*flagLinkMemprofile, data, 0666); err != nil {
 				log.Print(err)
 			}
 		}
-		os.Remove(pkgdir + "/_compilebench_.memprof")
+		os.Remove(out + ".memprof")
 	}
 
-	if *flagCpuprofile != "" {
-		out, err := ioutil.ReadFile(pkgdir + "/_compilebench_.cpuprof")
+	if *flagLinkCpuprofile != "" {
+		data, err := ioutil.ReadFile(out + ".cpuprof")
 		if err != nil {
 			log.Print(err)
 		}
-		if err := ioutil.WriteFile(*flagCpuprofile, out, 0666); err != nil {
+		if err := ioutil.WriteFile(*flagLinkCpuprofile, data, 0666); err != nil {
 			log.Print(err)
 		}
-		os.Remove(pkgdir + "/_compilebench_.cpuprof")
+		os.Remove(out + ".cpuprof")
 	}
 
 	wallns := end.Sub(start).Nanoseconds()
@@ -387,6 +1025,322 @@ func runBuild(name, dir, file string) {
 	} else {
 		fmt.Printf("%s 1 %d ns/op %d user-ns/op\n", name, wallns, userns)
 	}
+}
 
-	os.Remove(pkgdir + "/_compilebench_.o")
+// modPkg is the subset of the JSON object that ``go list -export -deps''
+// prints for a package that compilebench needs to time its compilation
+// directly: its own Go files, its dependencies' import paths, and (with
+// -export) the path to each dependency's compiled export data.
+type modPkg struct {
+	ImportPath string
+	Dir        string
+	GoFiles    []string
+	Deps       []string
+	Export     string
+}
+
+// goListExport runs ``go list -export -deps -json pattern'' in dir and
+// decodes the resulting stream of package objects, which includes pattern's
+// packages and their full transitive dependency closure (so that every
+// dependency's Export field is available to build an importcfg from).
+func goListExport(dir, pattern string) ([]modPkg, error) {
+	cmd := exec.Command("go", "list", "-export", "-deps", "-json", pattern)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list -export -deps -json %s: %v", pattern, err)
+	}
+	var pkgs []modPkg
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var p modPkg
+		if err := dec.Decode(&p); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		pkgs = append(pkgs, p)
+	}
+	return pkgs, nil
+}
+
+// topoSortPkgs orders pkgs so that each package appears after the
+// dependencies it shares with the rest of pkgs, so that BenchmarkMod rows
+// are printed in dependency order.
+func topoSortPkgs(pkgs []modPkg) []modPkg {
+	byPath := make(map[string]modPkg, len(pkgs))
+	for _, p := range pkgs {
+		byPath[p.ImportPath] = p
+	}
+	var order []modPkg
+	visited := make(map[string]bool)
+	var visit func(path string)
+	visit = func(path string) {
+		if visited[path] {
+			return
+		}
+		visited[path] = true
+		p, ok := byPath[path]
+		if !ok {
+			return
+		}
+		for _, dep := range p.Deps {
+			visit(dep)
+		}
+		order = append(order, p)
+	}
+	for _, p := range pkgs {
+		visit(p.ImportPath)
+	}
+	return order
+}
+
+// writeImportcfg writes a temporary importcfg file listing, for each
+// import path in deps, a ``packagefile path=export'' line pointing at its
+// compiled export data (as found in byPath), in the form -importcfg
+// expects. The caller is responsible for removing the returned file.
+func writeImportcfg(deps []string, byPath map[string]modPkg) (string, error) {
+	tmp, err := ioutil.TempFile("", "compilebench-importcfg")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+	for _, dep := range deps {
+		p, ok := byPath[dep]
+		if !ok || p.Export == "" {
+			continue
+		}
+		fmt.Fprintf(tmp, "packagefile %s=%s\n", dep, p.Export)
+	}
+	return tmp.Name(), nil
+}
+
+// runModPkg times compiling p directly with the compiler, using an
+// importcfg synthesized from p's dependencies' already-built export data,
+// and reports the result under name in the same style as runBuild.
+func runModPkg(name string, p modPkg, byPath map[string]modPkg) {
+	cfgFile, err := writeImportcfg(p.Deps, byPath)
+	if err != nil {
+		log.Printf("%v: %v", name, err)
+		return
+	}
+	defer os.Remove(cfgFile)
+
+	args := []string{"-o", "_compilebench_.o", "-importcfg", cfgFile, "-p", p.ImportPath}
+	if *flagMemprofilerate >= 0 {
+		args = append(args, "-memprofilerate", fmt.Sprint(*flagMemprofilerate))
+	}
+	args = append(args, strings.Fields(*flagCompilerFlags)...)
+	if *flagAlloc || *flagMemprofile != "" {
+		args = append(args, "-memprofile", "_compilebench_.memprof")
+	}
+	if *flagCpuprofile != "" {
+		args = append(args, "-cpuprofile", "_compilebench_.cpuprof")
+	}
+	args = append(args, p.GoFiles...)
+
+	cmd := exec.Command(compiler, args...)
+	cmd.Dir = p.Dir
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		log.Printf("%v: %v", name, err)
+		return
+	}
+	end := time.Now()
+
+	var allocs, bytes int64
+	if *flagAlloc || *flagMemprofile != "" {
+		out, err := ioutil.ReadFile(filepath.Join(p.Dir, "_compilebench_.memprof"))
+		if err != nil {
+			log.Print("cannot find memory profile after compilation")
+		}
+		bytes, allocs = parseMemprofileHeader(out)
+		if *flagMemprofile != "" {
+			memProfiles[name] = append(memProfiles[name], out)
+		}
+		os.Remove(filepath.Join(p.Dir, "_compilebench_.memprof"))
+	}
+
+	if *flagCpuprofile != "" {
+		out, err := ioutil.ReadFile(filepath.Join(p.Dir, "_compilebench_.cpuprof"))
+		if err != nil {
+			log.Print(err)
+		}
+		cpuProfiles[name] = append(cpuProfiles[name], out)
+		os.Remove(filepath.Join(p.Dir, "_compilebench_.cpuprof"))
+	}
+
+	wallns := end.Sub(start).Nanoseconds()
+	userns := cmd.ProcessState.UserTime().Nanoseconds()
+
+	if *flagAlloc {
+		fmt.Printf("%s 1 %d ns/op %d user-ns/op %d B/op %d allocs/op\n", name, wallns, userns, bytes, allocs)
+	} else {
+		fmt.Printf("%s 1 %d ns/op %d user-ns/op\n", name, wallns, userns)
+	}
+
+	os.Remove(filepath.Join(p.Dir, "_compilebench_.o"))
+}
+
+// gcPercents returns the GOGC values to sweep for the GC-stress
+// benchmarks, as set by -gcpercent, defaulting to a single run at 100.
+func gcPercents() []string {
+	if *flagGCPercent == "" {
+		return []string{"100"}
+	}
+	var percents []string
+	for _, p := range strings.Split(*flagGCPercent, ",") {
+		percents = append(percents, strings.TrimSpace(p))
+	}
+	return percents
+}
+
+// runGCStress times compiling file (in dir) under the given GOGC value
+// (a percentage, or "off"), reporting gc-ns/op, gc-cycles/op, and
+// heap-B/op in addition to the usual timing and, with -alloc, allocation
+// columns.
+func runGCStress(name, dir, file, percent string) {
+	label := fmt.Sprintf("%s/gogc=%s", name, percent)
+
+	args := []string{"-o", "_compilebench_.o"}
+	if *flagMemprofilerate >= 0 {
+		args = append(args, "-memprofilerate", fmt.Sprint(*flagMemprofilerate))
+	}
+	args = append(args, strings.Fields(*flagCompilerFlags)...)
+	args = append(args, "-memprofile", "_compilebench_.memprof", file)
+
+	cmd := exec.Command(compiler, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOGC="+percent)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		log.Printf("%v: %v", label, err)
+		return
+	}
+	end := time.Now()
+
+	out, err := ioutil.ReadFile(filepath.Join(dir, "_compilebench_.memprof"))
+	if err != nil {
+		log.Printf("%v: cannot find memory profile after compilation", label)
+		return
+	}
+	bytes, allocs := parseMemprofileHeader(out)
+	gcns, cycles, heap := parseGCStats(out)
+	os.Remove(filepath.Join(dir, "_compilebench_.memprof"))
+	os.Remove(filepath.Join(dir, "_compilebench_.o"))
+
+	wallns := end.Sub(start).Nanoseconds()
+	userns := cmd.ProcessState.UserTime().Nanoseconds()
+
+	if *flagAlloc {
+		fmt.Printf("%s 1 %d ns/op %d user-ns/op %d B/op %d allocs/op %d gc-ns/op %d gc-cycles/op %d heap-B/op\n",
+			label, wallns, userns, bytes, allocs, gcns, cycles, heap)
+	} else {
+		fmt.Printf("%s 1 %d ns/op %d user-ns/op %d gc-ns/op %d gc-cycles/op %d heap-B/op\n",
+			label, wallns, userns, gcns, cycles, heap)
+	}
+}
+
+// writeGenerated writes content to name inside dir and returns the full
+// path, for use by the gcTests generator functions below.
+func writeGenerated(dir, name, content string) (string, error) {
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(content), 0666); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// genParserStress generates a source file modeled on test/bench/garbage's
+// parser.go: a large table of small, heavily cross-referenced struct
+// literals, similar in shape to the node table a parser builds while
+// reading a large file.
+func genParserStress(dir string) (string, error) {
+	const n = 6000
+	var b strings.Builder
+	b.WriteString("package main\n\n")
+	b.WriteString("type token struct {\n\tkind     int\n\ttext     string\n\tchildren []*token\n}\n\n")
+	b.WriteString("var tokens = [...]*token{\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "\t{kind: %d, text: %q, children: []*token{{kind: %d, text: %q}, {kind: %d, text: %q}}},\n",
+			i%64, fmt.Sprintf("tok%d", i), (i+1)%64, fmt.Sprintf("c%da", i), (i+2)%64, fmt.Sprintf("c%db", i))
+	}
+	b.WriteString("}\n\nfunc main() {\n\t_ = tokens\n}\n")
+	return writeGenerated(dir, "parser_stress.go", b.String())
+}
+
+// genTreeStress generates a source file modeled on test/bench/garbage's
+// tree.go: a single binary tree expressed as one deeply nested composite
+// literal, stressing the compiler's handling of deep literal nesting.
+func genTreeStress(dir string) (string, error) {
+	const depth = 18
+	var build func(d int) string
+	build = func(d int) string {
+		if d == 0 {
+			return fmt.Sprintf("{Value: %d}", d)
+		}
+		return fmt.Sprintf("{Value: %d, Left: &Tree%s, Right: &Tree%s}", d, build(d-1), build(d-1))
+	}
+	var b strings.Builder
+	b.WriteString("package main\n\n")
+	b.WriteString("type Tree struct {\n\tValue       int\n\tLeft, Right *Tree\n}\n\n")
+	fmt.Fprintf(&b, "var root = &Tree%s\n\n", build(depth))
+	b.WriteString("func main() {\n\t_ = root\n}\n")
+	return writeGenerated(dir, "tree_stress.go", b.String())
+}
+
+// genTree2Stress generates a source file modeled on test/bench/garbage's
+// tree2.go: the same shape of tree as genTreeStress, but built by a loop
+// of top-level composite literals linked together by index rather than
+// one deeply nested literal, stressing many separate live allocations.
+func genTree2Stress(dir string) (string, error) {
+	const n = 20000
+	var b strings.Builder
+	b.WriteString("package main\n\n")
+	b.WriteString("type Tree2 struct {\n\tValue       int\n\tLeft, Right *Tree2\n}\n\n")
+	fmt.Fprintf(&b, "var nodes [%d]Tree2\n\n", n)
+	b.WriteString("func init() {\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "\tnodes[%d] = Tree2{Value: %d}\n", i, i)
+	}
+	for i := 1; i < n; i++ {
+		fmt.Fprintf(&b, "\tnodes[%d].Left = &nodes[%d]\n", (i-1)/2, i)
+	}
+	b.WriteString("}\n\nfunc main() {\n\t_ = nodes\n}\n")
+	return writeGenerated(dir, "tree2_stress.go", b.String())
+}
+
+// genPeanoStress generates a source file modeled on test/bench/garbage's
+// peano.go: a chain of types representing Peano numbers, each embedding
+// the previous one, together with a dense graph of interfaces that every
+// number in the chain satisfies, stressing both deep recursive types and
+// interface-satisfaction checking.
+func genPeanoStress(dir string) (string, error) {
+	const n = 800
+	const ifaces = 8
+	var b strings.Builder
+	b.WriteString("package main\n\n")
+	for j := 0; j < ifaces; j++ {
+		fmt.Fprintf(&b, "type Number%d interface {\n\tIsZero%d() bool\n}\n\n", j, j)
+	}
+	b.WriteString("type Peano0 struct{}\n\n")
+	for j := 0; j < ifaces; j++ {
+		fmt.Fprintf(&b, "func (Peano0) IsZero%d() bool { return true }\n", j)
+	}
+	b.WriteString("\n")
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&b, "type Peano%d struct{ Prev Peano%d }\n\n", i, i-1)
+		for j := 0; j < ifaces; j++ {
+			fmt.Fprintf(&b, "func (p Peano%d) IsZero%d() bool { return false }\n", i, j)
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "var top = Peano%d{}\n\n", n)
+	b.WriteString("func main() {\n\t_ = top\n}\n")
+	return writeGenerated(dir, "peano_stress.go", b.String())
 }
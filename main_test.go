@@ -0,0 +1,21 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestParsePauseNs(t *testing.T) {
+	const header = `# runtime.MemStats
+# Alloc = 844000
+# TotalAlloc = 844000
+# Mallocs = 7309
+# HeapAlloc = 844000
+# PauseNs = [113021 59700 0 0 0 0 0 0]
+# NumGC = 2
+`
+	if got, want := parsePauseNs([]byte(header)), int64(113021+59700); got != want {
+		t.Errorf("parsePauseNs = %d, want %d", got, want)
+	}
+}